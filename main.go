@@ -7,19 +7,31 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
 
 	"github.com/TheEntropyCollective/randomfs-core"
 	"github.com/gorilla/mux"
 )
 
 var (
-	httpPort  = flag.Int("port", 8080, "HTTP server port")
-	ipfsAPI   = flag.String("ipfs", "http://localhost:5001", "IPFS API endpoint")
-	dataDir   = flag.String("data", "./data", "Data directory")
-	cacheSize = flag.Int64("cache", 500*1024*1024, "Cache size in bytes")
-	webDir    = flag.String("web", "./web", "Web interface directory")
+	httpPort          = flag.Int("port", 8080, "HTTP server port")
+	ipfsAPI           = flag.String("ipfs", "http://localhost:5001", "IPFS API endpoint")
+	dataDir           = flag.String("data", "./data", "Data directory")
+	cacheSize         = flag.Int64("cache", 500*1024*1024, "Cache size in bytes")
+	webDir            = flag.String("web", "./web", "Web interface directory")
+	maxUploadKbps     = flag.Int64("max-upload-kbps", 0, "Max sustained upload rate to IPFS in kbps (0 = unlimited)")
+	maxDownloadKbps   = flag.Int64("max-download-kbps", 0, "Max sustained download rate from IPFS in kbps (0 = unlimited)")
+	maxInflightBlocks = flag.Int("max-inflight-blocks", 16, "Max concurrent in-flight IPFS requests (0 = unlimited)")
+	maxInflightBytes  = flag.Int64("max-inflight-bytes", 0, "Max total bytes of concurrently in-flight IPFS blocks (0 = unlimited)")
+	dedupMode         = flag.String("dedup", "off", "Content-addressed block deduplication: on|off")
+	pinMode           = flag.String("pin", "recursive", "Pin mode for stored CIDs: recursive|direct|none")
+	publishMFS        = flag.Bool("publish-mfs", false, "Publish each stored file into MFS at /randomfs/<filename>")
+	logFormat         = flag.String("log-format", "text", "Request log format: text|json")
+	logLevel          = flag.String("log-level", "info", "Log level: debug|info|warn|error")
 )
 
 type Server struct {
@@ -36,29 +48,48 @@ func (s *Server) handleStore(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	file, header, err := r.FormFile("file")
+	// Parse the multipart body by hand instead of calling r.FormFile, which
+	// runs ParseMultipartForm under the hood and buffers the whole upload
+	// (to memory below 32MB, to a temp file above it) before StoreStream
+	// ever sees it. Reading the part directly gives StoreStream a genuine
+	// pass-through from the request body.
+	mr, err := r.MultipartReader()
 	if err != nil {
-		http.Error(w, "Failed to read file: "+err.Error(), http.StatusBadRequest)
+		http.Error(w, "Failed to read multipart request: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
 
-	data, err := io.ReadAll(file)
-	if err != nil {
-		http.Error(w, "Failed to read file data: "+err.Error(), http.StatusInternalServerError)
-		return
+	var part *multipart.Part
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			http.Error(w, "Missing \"file\" part", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to read multipart request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if p.FormName() == "file" {
+			part = p
+			break
+		}
+		p.Close()
 	}
+	defer part.Close()
 
-	contentType := header.Header.Get("Content-Type")
+	contentType := part.Header.Get("Content-Type")
 	if contentType == "" {
 		contentType = "application/octet-stream"
 	}
 
-	randomURL, err := s.rfs.StoreFile(header.Filename, data, contentType)
+	// Stream the upload straight to IPFS instead of buffering it in memory.
+	randomURL, err := s.rfs.StoreStream(part.FileName(), part, contentType)
 	if err != nil {
 		http.Error(w, "Failed to store file: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	bytesStoredTotal.Add(float64(randomURL.FileSize))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -74,16 +105,7 @@ func (s *Server) handleRetrieve(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	hash := vars["hash"]
 
-	data, rep, err := s.rfs.RetrieveFile(hash)
-	if err != nil {
-		http.Error(w, "Failed to retrieve file: "+err.Error(), http.StatusNotFound)
-		return
-	}
-
-	w.Header().Set("Content-Type", rep.ContentType)
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", rep.FileName))
-	w.Header().Set("Content-Length", strconv.FormatInt(rep.FileSize, 10))
-	w.Write(data)
+	s.serveFile(w, r, hash, "attachment")
 }
 
 func (s *Server) handleRandomURL(w http.ResponseWriter, r *http.Request) {
@@ -103,16 +125,100 @@ func (s *Server) handleRandomURL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data, rep, err := s.rfs.RetrieveFile(randomURL.RepHash)
+	s.serveFile(w, r, randomURL.RepHash, "inline")
+}
+
+// serveFile streams the file identified by hash to w, honoring a Range
+// request header with a single byte range. disposition is "attachment" or
+// "inline" and controls the Content-Disposition header.
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, hash, disposition string) {
+	rep, err := s.rfs.GetRepresentation(hash)
 	if err != nil {
 		http.Error(w, "Failed to retrieve file: "+err.Error(), http.StatusNotFound)
 		return
 	}
 
 	w.Header().Set("Content-Type", rep.ContentType)
-	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", rep.FileName))
-	w.Header().Set("Content-Length", strconv.FormatInt(rep.FileSize, 10))
-	w.Write(data)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=\"%s\"", disposition, rep.FileName))
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	off, length := int64(0), rep.FileSize
+	status := http.StatusOK
+
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		start, end, err := parseRangeHeader(rangeHeader, rep.FileSize)
+		if err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", rep.FileSize))
+			http.Error(w, "Invalid range: "+err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		off, length = start, end-start+1
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, rep.FileSize))
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(status)
+
+	if err := s.rfs.RetrieveStreamFromRepresentation(rep, w, off, length); err != nil {
+		log.Printf("Failed to stream file %s: %v", hash, err)
+		return
+	}
+	bytesRetrievedTotal.Add(float64(length))
+}
+
+// parseRangeHeader parses a single-range "bytes=start-end" Range header value
+// and returns the inclusive start/end byte offsets, clamped to fileSize.
+func parseRangeHeader(header string, fileSize int64) (start, end int64, err error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return 0, 0, fmt.Errorf("unsupported range unit")
+	}
+
+	spec := strings.TrimPrefix(header, prefix)
+	if strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("multiple ranges not supported")
+	}
+
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("malformed range")
+	}
+
+	if parts[0] == "" {
+		// Suffix range: last N bytes.
+		suffixLen, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || suffixLen <= 0 {
+			return 0, 0, fmt.Errorf("malformed suffix range")
+		}
+		if suffixLen > fileSize {
+			suffixLen = fileSize
+		}
+		return fileSize - suffixLen, fileSize - 1, nil
+	}
+
+	start, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("malformed range start")
+	}
+
+	if parts[1] == "" {
+		end = fileSize - 1
+	} else {
+		end, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("malformed range end")
+		}
+	}
+
+	if end >= fileSize {
+		end = fileSize - 1
+	}
+	if start > end {
+		return 0, 0, fmt.Errorf("range start past end of file")
+	}
+
+	return start, end, nil
 }
 
 func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
@@ -125,6 +231,20 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (s *Server) handleCachePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.rfs.PurgeCache()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+	})
+}
+
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -134,21 +254,149 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// parseDedupMode parses the -dedup flag value ("on" or "off").
+func parseDedupMode(mode string) (bool, error) {
+	switch mode {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	default:
+		return false, fmt.Errorf("must be \"on\" or \"off\", got %q", mode)
+	}
+}
+
+// parsePinMode validates the -pin flag value.
+func parsePinMode(mode string) (string, error) {
+	switch mode {
+	case "recursive", "direct", "none":
+		return mode, nil
+	default:
+		return "", fmt.Errorf("must be one of recursive|direct|none, got %q", mode)
+	}
+}
+
+func (s *Server) handleUnpin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	vars := mux.Vars(r)
+	hash := vars["hash"]
+
+	if err := s.rfs.UnpinHash(hash); err != nil {
+		http.Error(w, "Failed to unpin: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+	})
+}
+
+func (s *Server) handleGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.rfs.GC(); err != nil {
+		http.Error(w, "GC failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+	})
+}
+
+func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	repHash := r.URL.Query().Get("hash")
+	if repHash == "" {
+		http.Error(w, "Missing \"hash\" query parameter", http.StatusBadRequest)
+		return
+	}
+
+	ipnsName, err := s.rfs.PublishLatest(name, repHash)
+	if err != nil {
+		http.Error(w, "Failed to publish: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"name":    ipnsName,
+	})
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "mount" {
+		if err := runMount(os.Args[2:]); err != nil {
+			log.Fatalf("mount: %v", err)
+		}
+		return
+	}
+
 	flag.Parse()
 
 	log.Printf("Starting RandomFS HTTP Server")
 	log.Printf("IPFS API: %s", *ipfsAPI)
 	log.Printf("Data Dir: %s", *dataDir)
 	log.Printf("Cache Size: %d bytes", *cacheSize)
+	log.Printf("Max Upload Rate: %d kbps", *maxUploadKbps)
+	log.Printf("Max Download Rate: %d kbps", *maxDownloadKbps)
+	log.Printf("Max In-flight Blocks: %d", *maxInflightBlocks)
+	log.Printf("Max In-flight Bytes: %d", *maxInflightBytes)
+	log.Printf("Dedup: %s", *dedupMode)
+	log.Printf("Pin Mode: %s", *pinMode)
+	log.Printf("Publish to MFS: %v", *publishMFS)
+	log.Printf("Log Format: %s", *logFormat)
+	log.Printf("Log Level: %s", *logLevel)
 	log.Printf("Web Dir: %s", *webDir)
 	log.Printf("HTTP Port: %d", *httpPort)
 
+	dedup, err := parseDedupMode(*dedupMode)
+	if err != nil {
+		log.Fatalf("Invalid -dedup value: %v", err)
+	}
+
+	pin, err := parsePinMode(*pinMode)
+	if err != nil {
+		log.Fatalf("Invalid -pin value: %v", err)
+	}
+
+	logger := newLogger(*logFormat, *logLevel)
+
 	// Create RandomFS instance
-	rfs, err := randomfs.NewRandomFS(*ipfsAPI, *dataDir, *cacheSize)
+	rfs, err := randomfs.NewRandomFSWithConfig(randomfs.Config{
+		IPFSAPI:           *ipfsAPI,
+		DataDir:           *dataDir,
+		CacheSize:         *cacheSize,
+		MaxUploadBps:      *maxUploadKbps * 1024 / 8,
+		MaxDownloadBps:    *maxDownloadKbps * 1024 / 8,
+		MaxInflightBlocks: *maxInflightBlocks,
+		MaxInflightBytes:  *maxInflightBytes,
+		Dedup:             dedup,
+		PinMode:           pin,
+		PublishMFS:        *publishMFS,
+		OnIPFSCall:        recordIPFSCall,
+	})
 	if err != nil {
 		log.Fatalf("Failed to initialize RandomFS: %v", err)
 	}
+	registerCacheMetrics(rfs)
 
 	// Create server
 	server := NewServer(rfs)
@@ -161,14 +409,24 @@ func main() {
 	api.HandleFunc("/store", server.handleStore).Methods("POST")
 	api.HandleFunc("/retrieve/{hash}", server.handleRetrieve).Methods("GET")
 	api.HandleFunc("/stats", server.handleStats).Methods("GET")
+	api.HandleFunc("/cache/purge", server.handleCachePurge).Methods("POST")
+	api.HandleFunc("/unpin/{hash}", server.handleUnpin).Methods("POST")
+	api.HandleFunc("/gc", server.handleGC).Methods("POST")
+	api.HandleFunc("/publish/{name}", server.handlePublish).Methods("POST")
 	api.HandleFunc("/health", server.handleHealth).Methods("GET")
 
 	// rd:// URL handler
 	router.HandleFunc("/rd/{encodedURL:.*}", server.handleRandomURL).Methods("GET")
 
+	// Prometheus metrics
+	router.Handle("/metrics", metricsHandler()).Methods("GET")
+
 	// Serve web interface
 	router.PathPrefix("/").Handler(http.FileServer(http.Dir(*webDir + "/")))
 
+	// Structured request logging and metrics
+	router.Use(loggingMetricsMiddleware(logger))
+
 	// CORS middleware
 	router.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -192,8 +450,13 @@ func main() {
 	log.Printf("  POST /api/v1/store       - Store a file")
 	log.Printf("  GET  /api/v1/retrieve/{hash} - Retrieve a file")
 	log.Printf("  GET  /api/v1/stats       - Get system stats")
+	log.Printf("  POST /api/v1/cache/purge - Purge the block cache")
+	log.Printf("  POST /api/v1/unpin/{hash} - Unpin a CID")
+	log.Printf("  POST /api/v1/gc          - Trigger IPFS repo garbage collection")
+	log.Printf("  POST /api/v1/publish/{name}?hash={repHash} - Publish an IPNS \"latest\" pointer")
 	log.Printf("  GET  /api/v1/health      - Health check")
 	log.Printf("  GET  /rd/{encoded-url}   - Access via rd:// URL")
+	log.Printf("  GET  /metrics            - Prometheus metrics")
 
 	if err := http.ListenAndServe(addr, router); err != nil {
 		log.Fatalf("Server failed to start: %v", err)
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/TheEntropyCollective/randomfs-core"
+	"github.com/gorilla/mux"
+)
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "randomfs_http_requests_total",
+		Help: "Total HTTP requests handled, by route and status code.",
+	}, []string{"route", "code"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "randomfs_http_request_duration_seconds",
+		Help:    "HTTP request latency in seconds, by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+
+	bytesStoredTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "randomfs_bytes_stored_total",
+		Help: "Total bytes accepted by /api/v1/store.",
+	})
+
+	bytesRetrievedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "randomfs_bytes_retrieved_total",
+		Help: "Total bytes served by the retrieve/rd:// handlers.",
+	})
+
+	ipfsCallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "randomfs_ipfs_call_duration_seconds",
+		Help:    "Latency of calls made to the IPFS daemon, by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"op"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		httpRequestsTotal,
+		httpRequestDuration,
+		bytesStoredTotal,
+		bytesRetrievedTotal,
+		ipfsCallDuration,
+	)
+}
+
+// registerCacheMetrics exposes rfs's cache counters as Prometheus counters.
+// They're backed by the same atomic counters GetStats reads, so values stay
+// consistent with the JSON /api/v1/stats snapshot.
+func registerCacheMetrics(rfs *randomfs.RandomFS) {
+	prometheus.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "randomfs_cache_hits_total",
+			Help: "Total block cache hits.",
+		}, func() float64 { return float64(rfs.GetStats().CacheHits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "randomfs_cache_misses_total",
+			Help: "Total block cache misses.",
+		}, func() float64 { return float64(rfs.GetStats().CacheMisses) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "randomfs_cache_evictions_total",
+			Help: "Total block cache evictions.",
+		}, func() float64 { return float64(rfs.GetStats().CacheEvictions) }),
+	)
+}
+
+// recordIPFSCall is passed to randomfs.Config.OnIPFSCall to feed
+// randomfs_ipfs_call_duration_seconds from inside the core package without
+// it depending on Prometheus.
+func recordIPFSCall(op string, d time.Duration, err error) {
+	ipfsCallDuration.WithLabelValues(op).Observe(d.Seconds())
+}
+
+// newLogger builds the process-wide structured logger from the
+// --log-format/--log-level flags.
+func newLogger(format, level string) *slog.Logger {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		lvl = slog.LevelInfo
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	if format == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	return slog.New(handler)
+}
+
+// newRequestID returns a short random hex string used to correlate a
+// request's log lines.
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// statusWriter wraps an http.ResponseWriter to capture the status code and
+// byte count written, for logging and metrics.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// loggingMetricsMiddleware assigns a request ID, logs the completed request,
+// and records it to the Prometheus counters/histogram above.
+func loggingMetricsMiddleware(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			reqID := newRequestID()
+			sw := &statusWriter{ResponseWriter: w}
+
+			next.ServeHTTP(sw, r)
+
+			if sw.status == 0 {
+				sw.status = http.StatusOK
+			}
+			duration := time.Since(start)
+			route := routeLabel(r)
+
+			logger.Info("http request",
+				"request_id", reqID,
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", sw.status,
+				"bytes", sw.bytes,
+				"duration_ms", duration.Milliseconds(),
+			)
+
+			code := strconv.Itoa(sw.status)
+			httpRequestsTotal.WithLabelValues(route, code).Inc()
+			httpRequestDuration.WithLabelValues(route).Observe(duration.Seconds())
+		})
+	}
+}
+
+// routeLabel derives a low-cardinality Prometheus label from the request
+// path, collapsing path parameters (hashes, names) into a placeholder.
+func routeLabel(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return r.URL.Path
+	}
+	if tpl, err := route.GetPathTemplate(); err == nil {
+		return tpl
+	}
+	return r.URL.Path
+}
+
+// metricsHandler serves the Prometheus exposition format at /metrics.
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
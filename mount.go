@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+
+	"github.com/TheEntropyCollective/randomfs-core"
+)
+
+const (
+	// mountPrefetchBlockSize is the unit of reads fetched from RetrieveStream
+	// and cached per open file, sized for contiguous sequential reads.
+	mountPrefetchBlockSize = 1 << 20 // 1 MiB
+	// mountPrefetchCacheBlocks bounds how many prefetch blocks are kept per
+	// open file handle.
+	mountPrefetchCacheBlocks = 16
+	// mountIndexPointerFile stores the repHash of the most recently published
+	// directory index, so a later mount can resume without re-scanning IPFS.
+	mountIndexPointerFile = "mount-index.txt"
+	mountIndexName        = "randomfs-index.json"
+)
+
+// indexEntry records where a mounted file's contents live.
+type indexEntry struct {
+	RepHash string `json:"rep_hash"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mod_time"`
+}
+
+// runMount implements the `randomfs-http mount <mountpoint>` subcommand: it
+// mounts a read-write FUSE filesystem backed by RandomFS, where each entry is
+// a rd:// file and the directory listing is a small JSON index stored in
+// IPFS like any other file.
+func runMount(args []string) error {
+	fset := flag.NewFlagSet("mount", flag.ExitOnError)
+	ipfsAPI := fset.String("ipfs", "http://localhost:5001", "IPFS API endpoint")
+	dataDir := fset.String("data", "./data", "Data directory")
+	cacheSize := fset.Int64("cache", 500*1024*1024, "Block cache size in bytes")
+	readOnly := fset.Bool("read-only", false, "Mount the filesystem read-only")
+	allowOther := fset.Bool("allow-other", false, "Allow other users to access the mount")
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if fset.NArg() != 1 {
+		return fmt.Errorf("usage: randomfs-http mount [flags] <mountpoint>")
+	}
+	mountpoint := fset.Arg(0)
+
+	rfs, err := randomfs.NewRandomFSWithConfig(randomfs.Config{
+		IPFSAPI:   *ipfsAPI,
+		DataDir:   *dataDir,
+		CacheSize: *cacheSize,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to initialize RandomFS: %v", err)
+	}
+
+	mfs, err := newMountFS(rfs, *dataDir, *readOnly)
+	if err != nil {
+		return fmt.Errorf("failed to load directory index: %v", err)
+	}
+
+	options := []fuse.MountOption{
+		fuse.FSName("randomfs"),
+		fuse.Subtype("randomfs"),
+	}
+	if *readOnly {
+		options = append(options, fuse.ReadOnly())
+	}
+	if *allowOther {
+		options = append(options, fuse.AllowOther())
+	}
+
+	conn, err := fuse.Mount(mountpoint, options...)
+	if err != nil {
+		return fmt.Errorf("failed to mount %s: %v", mountpoint, err)
+	}
+	defer conn.Close()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		log.Printf("Unmounting %s", mountpoint)
+		fuse.Unmount(mountpoint)
+	}()
+
+	log.Printf("Mounted RandomFS at %s (read-only=%v)", mountpoint, *readOnly)
+	if err := fs.Serve(conn, mfs); err != nil {
+		return fmt.Errorf("fuse serve failed: %v", err)
+	}
+
+	<-conn.Ready
+	return conn.MountError
+}
+
+// mountFS is the root of the mounted filesystem. It keeps the directory
+// index (filename -> indexEntry) in memory and persists it to IPFS as a
+// regular RandomFS file on every mutation.
+type mountFS struct {
+	rfs      *randomfs.RandomFS
+	dataDir  string
+	readOnly bool
+
+	mu      sync.Mutex
+	entries map[string]*indexEntry
+}
+
+func newMountFS(rfs *randomfs.RandomFS, dataDir string, readOnly bool) (*mountFS, error) {
+	mfs := &mountFS{
+		rfs:      rfs,
+		dataDir:  dataDir,
+		readOnly: readOnly,
+		entries:  make(map[string]*indexEntry),
+	}
+
+	pointerPath := filepath.Join(dataDir, mountIndexPointerFile)
+	pointer, err := os.ReadFile(pointerPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return mfs, nil
+		}
+		return nil, err
+	}
+
+	repHash := string(bytes.TrimSpace(pointer))
+	if repHash == "" {
+		return mfs, nil
+	}
+
+	data, _, err := mfs.rfs.RetrieveFile(repHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve directory index %s: %v", repHash, err)
+	}
+	if err := json.Unmarshal(data, &mfs.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse directory index: %v", err)
+	}
+	return mfs, nil
+}
+
+// persist marshals the current index, stores it as a RandomFS file, and
+// records the resulting rep hash locally so it survives a remount. Caller
+// must hold mfs.mu.
+func (mfs *mountFS) persist() error {
+	data, err := json.Marshal(mfs.entries)
+	if err != nil {
+		return err
+	}
+
+	url, err := mfs.rfs.StoreFile(mountIndexName, data, "application/json")
+	if err != nil {
+		return err
+	}
+
+	pointerPath := filepath.Join(mfs.dataDir, mountIndexPointerFile)
+	return os.WriteFile(pointerPath, []byte(url.RepHash), 0644)
+}
+
+func (mfs *mountFS) Root() (fs.Node, error) {
+	return &mountDir{fs: mfs}, nil
+}
+
+// mountDir is the single flat root directory; RandomFS has no notion of
+// subdirectories, so the index is presented as one directory of files.
+type mountDir struct {
+	fs *mountFS
+}
+
+func (d *mountDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0755
+	return nil
+}
+
+func (d *mountDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	d.fs.mu.Lock()
+	entry, ok := d.fs.entries[name]
+	d.fs.mu.Unlock()
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return &mountFile{fs: d.fs, name: name, entry: entry}, nil
+}
+
+func (d *mountDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	d.fs.mu.Lock()
+	defer d.fs.mu.Unlock()
+
+	dirents := make([]fuse.Dirent, 0, len(d.fs.entries))
+	for name := range d.fs.entries {
+		dirents = append(dirents, fuse.Dirent{Name: name, Type: fuse.DT_File})
+	}
+	return dirents, nil
+}
+
+func (d *mountDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	if d.fs.readOnly {
+		return nil, nil, fuse.EPERM
+	}
+
+	entry := &indexEntry{ModTime: clockNow()}
+	f := &mountFile{fs: d.fs, name: req.Name, entry: entry}
+	h := &mountWriteHandle{file: f}
+	return f, h, nil
+}
+
+// mountFile represents a single stored file. Its content lives entirely in
+// IPFS under entry.RepHash; the node only caches metadata.
+type mountFile struct {
+	fs    *mountFS
+	name  string
+	entry *indexEntry
+}
+
+func (f *mountFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	entry := f.snapshot()
+	a.Mode = 0644
+	a.Size = uint64(entry.Size)
+	a.Mtime = time.Unix(entry.ModTime, 0)
+	return nil
+}
+
+// snapshot returns a copy of f.entry taken under fs.mu. FUSE dispatches
+// reads, writes, and getattr from separate goroutines, and commit() mutates
+// entry's fields in place, so every read of entry's fields must go through
+// this instead of dereferencing f.entry directly.
+func (f *mountFile) snapshot() indexEntry {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return *f.entry
+}
+
+func (f *mountFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if req.Flags.IsWriteOnly() || req.Flags.IsReadWrite() {
+		if f.fs.readOnly {
+			return nil, fuse.EPERM
+		}
+		return &mountWriteHandle{file: f}, nil
+	}
+	return newMountReadHandle(f), nil
+}
+
+// mountWriteHandle buffers the full write in memory and commits it to
+// RandomFS on Flush, matching StoreFile's whole-buffer signature. Release
+// does not commit.
+type mountWriteHandle struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+
+	file *mountFile
+}
+
+func (h *mountWriteHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if need := int(req.Offset) + len(req.Data) - h.buf.Len(); need > 0 {
+		h.buf.Grow(need)
+	}
+	b := h.buf.Bytes()
+	if int(req.Offset)+len(req.Data) > len(b) {
+		grown := make([]byte, int(req.Offset)+len(req.Data))
+		copy(grown, b)
+		h.buf.Reset()
+		h.buf.Write(grown)
+		b = h.buf.Bytes()
+	}
+	copy(b[req.Offset:], req.Data)
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (h *mountWriteHandle) commit() error {
+	h.mu.Lock()
+	data := append([]byte(nil), h.buf.Bytes()...)
+	h.mu.Unlock()
+
+	url, err := h.file.fs.rfs.StoreFile(h.file.name, data, "application/octet-stream")
+	if err != nil {
+		return fmt.Errorf("failed to store %s: %v", h.file.name, err)
+	}
+
+	h.file.fs.mu.Lock()
+	h.file.entry.RepHash = url.RepHash
+	h.file.entry.Size = int64(len(data))
+	h.file.entry.ModTime = clockNow()
+	h.file.fs.entries[h.file.name] = h.file.entry
+	err = h.file.fs.persist()
+	h.file.fs.mu.Unlock()
+	return err
+}
+
+func (h *mountWriteHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	return h.commit()
+}
+
+func (h *mountWriteHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return nil
+}
+
+// mountReadHandle serves reads out of a per-file prefetch cache of fixed-size
+// blocks, populated on demand via RetrieveStreamFromRepresentation.
+type mountReadHandle struct {
+	file  *mountFile
+	cache *prefetchCache
+
+	repMu   sync.Mutex
+	repHash string
+	rep     *randomfs.FileRepresentation
+}
+
+// representationFor returns the FileRepresentation for repHash, resolving it
+// via IPFS only the first time it's needed (or after a commit changes
+// entry.RepHash underneath the handle) instead of once per prefetch block.
+func (h *mountReadHandle) representationFor(repHash string) (*randomfs.FileRepresentation, error) {
+	h.repMu.Lock()
+	defer h.repMu.Unlock()
+
+	if h.rep != nil && h.repHash == repHash {
+		return h.rep, nil
+	}
+
+	rep, err := h.file.fs.rfs.GetRepresentation(repHash)
+	if err != nil {
+		return nil, err
+	}
+	h.repHash = repHash
+	h.rep = rep
+	return rep, nil
+}
+
+func newMountReadHandle(f *mountFile) *mountReadHandle {
+	h := &mountReadHandle{file: f}
+	h.cache = newPrefetchCache(mountPrefetchCacheBlocks, func(blockIndex int64) ([]byte, error) {
+		entry := f.snapshot()
+		rep, err := h.representationFor(entry.RepHash)
+		if err != nil {
+			return nil, err
+		}
+		off := blockIndex * mountPrefetchBlockSize
+		length := int64(mountPrefetchBlockSize)
+		if off+length > entry.Size {
+			length = entry.Size - off
+		}
+		if length <= 0 {
+			return nil, nil
+		}
+		var buf bytes.Buffer
+		if err := f.fs.rfs.RetrieveStreamFromRepresentation(rep, &buf, off, length); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	})
+	return h
+}
+
+func (h *mountReadHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	size := h.file.snapshot().Size
+	if req.Offset >= size {
+		return nil
+	}
+
+	end := req.Offset + int64(req.Size)
+	if end > size {
+		end = size
+	}
+
+	var out []byte
+	for pos := req.Offset; pos < end; {
+		blockIndex := pos / mountPrefetchBlockSize
+		block, err := h.cache.get(blockIndex)
+		if err != nil {
+			return err
+		}
+		blockStart := blockIndex * mountPrefetchBlockSize
+		skip := pos - blockStart
+		if skip >= int64(len(block)) {
+			break
+		}
+		want := end - pos
+		avail := int64(len(block)) - skip
+		if want > avail {
+			want = avail
+		}
+		out = append(out, block[skip:skip+want]...)
+		pos += want
+	}
+
+	resp.Data = out
+	return nil
+}
+
+func (h *mountReadHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return nil
+}
+
+// prefetchCache is a small LRU of fixed-size blocks for one open file,
+// populated by fetch on miss. It favors simplicity over the root block
+// cache's single-flight coalescing, since it's scoped to one reader.
+type prefetchCache struct {
+	mu        sync.Mutex
+	items     map[int64]*list.Element
+	lru       *list.List
+	maxBlocks int
+	fetch     func(int64) ([]byte, error)
+}
+
+type prefetchCacheEntry struct {
+	index int64
+	data  []byte
+}
+
+func newPrefetchCache(maxBlocks int, fetch func(int64) ([]byte, error)) *prefetchCache {
+	return &prefetchCache{
+		items:     make(map[int64]*list.Element),
+		lru:       list.New(),
+		maxBlocks: maxBlocks,
+		fetch:     fetch,
+	}
+}
+
+func (c *prefetchCache) get(index int64) ([]byte, error) {
+	c.mu.Lock()
+	if elem, ok := c.items[index]; ok {
+		c.lru.MoveToFront(elem)
+		data := elem.Value.(*prefetchCacheEntry).data
+		c.mu.Unlock()
+		return data, nil
+	}
+	c.mu.Unlock()
+
+	data, err := c.fetch(index)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem := c.lru.PushFront(&prefetchCacheEntry{index: index, data: data})
+	c.items[index] = elem
+	for c.lru.Len() > c.maxBlocks {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			break
+		}
+		c.lru.Remove(oldest)
+		delete(c.items, oldest.Value.(*prefetchCacheEntry).index)
+	}
+	return data, nil
+}
+
+// clockNow returns the current Unix time; split out so the rest of the file
+// reads like the core package's use of time.Now().Unix().
+func clockNow() int64 {
+	return time.Now().Unix()
+}
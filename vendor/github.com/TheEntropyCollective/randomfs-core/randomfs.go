@@ -2,20 +2,25 @@ package randomfs
 
 import (
 	"bytes"
+	"container/list"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
-	"mime/multipart"
-	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	shell "github.com/ipfs/go-ipfs-api"
+	bolt "go.etcd.io/bbolt"
 )
 
 const (
@@ -33,17 +38,249 @@ const (
 
 	// Default IPFS API endpoint
 	DefaultIPFSEndpoint = "http://localhost:5001"
+
+	// streamWorkers bounds the number of blocks uploaded to IPFS concurrently
+	// by StoreStream.
+	streamWorkers = 4
+
+	// negativeCacheTTL is how long a NotFound result is remembered for a
+	// block hash before it is retried against IPFS.
+	negativeCacheTTL = 30 * time.Second
+
+	// dedupIndexFileName is the BoltDB file used to map chunk hashes to the
+	// randomizer/result block pair stored for them, when dedup is enabled.
+	dedupIndexFileName = "blocks.db"
 )
 
+// dedupBucket is the BoltDB bucket holding chunk-hash -> dedupEntry records.
+var dedupBucket = []byte("blocks")
+
+// dedupEntry records the randomizer and XOR-result block CIDs previously
+// stored for a given source chunk hash, so an identical chunk can reuse them
+// instead of writing a new block to IPFS.
+type dedupEntry struct {
+	RandomizerHash string `json:"randomizer_hash"`
+	ResultHash     string `json:"result_hash"`
+}
+
+// dedupIndex is a persistent sha256(chunk) -> dedupEntry index backed by
+// BoltDB, used to deduplicate identical chunks across StoreFile/StoreStream
+// calls.
+type dedupIndex struct {
+	db *bolt.DB
+}
+
+// openDedupIndex opens (creating if necessary) the dedup index under
+// dataDir.
+func openDedupIndex(dataDir string) (*dedupIndex, error) {
+	db, err := bolt.Open(filepath.Join(dataDir, dedupIndexFileName), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dedup index: %v", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(dedupBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize dedup index: %v", err)
+	}
+
+	return &dedupIndex{db: db}, nil
+}
+
+// lookup returns the dedupEntry previously recorded for chunkHash, if any.
+func (idx *dedupIndex) lookup(chunkHash [32]byte) (dedupEntry, bool, error) {
+	var entry dedupEntry
+	found := false
+
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(dedupBucket).Get(chunkHash[:])
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &entry)
+	})
+
+	return entry, found, err
+}
+
+// store records entry for chunkHash.
+func (idx *dedupIndex) store(chunkHash [32]byte, entry dedupEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(dedupBucket).Put(chunkHash[:], data)
+	})
+}
+
+// Close releases the underlying BoltDB file.
+func (idx *dedupIndex) Close() error {
+	return idx.db.Close()
+}
+
+// ErrBlockNotFound is returned when a block hash is not found on IPFS.
+var ErrBlockNotFound = fmt.Errorf("block not found")
+
+// byteSemaphore bounds the number of bytes that may be in flight to/from
+// IPFS at once, so large concurrent uploads/downloads can't run the process
+// out of memory or saturate the daemon.
+type byteSemaphore struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	max  int64
+	used int64
+}
+
+// newByteSemaphore creates a byteSemaphore capped at max bytes. A max of 0
+// disables the cap.
+func newByteSemaphore(max int64) *byteSemaphore {
+	s := &byteSemaphore{max: max}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// take blocks until n bytes of budget are available, then reserves them.
+func (s *byteSemaphore) take(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.max > 0 && s.used+n > s.max {
+		s.cond.Wait()
+	}
+	s.used += n
+}
+
+// give releases n bytes of budget previously reserved with take.
+func (s *byteSemaphore) give(n int64) {
+	s.mu.Lock()
+	s.used -= n
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// inUse returns the number of bytes currently reserved.
+func (s *byteSemaphore) inUse() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used
+}
+
+// concurrencySemaphore bounds the number of in-flight IPFS HTTP requests. A
+// nil concurrencySemaphore is unbounded.
+type concurrencySemaphore chan struct{}
+
+// newConcurrencySemaphore creates a concurrencySemaphore allowing up to n
+// concurrent holders. An n of 0 returns an unbounded semaphore.
+func newConcurrencySemaphore(n int) concurrencySemaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(concurrencySemaphore, n)
+}
+
+func (c concurrencySemaphore) acquire() {
+	if c != nil {
+		c <- struct{}{}
+	}
+}
+
+func (c concurrencySemaphore) release() {
+	if c != nil {
+		<-c
+	}
+}
+
+func (c concurrencySemaphore) inUse() int {
+	return len(c)
+}
+
+// tokenBucket is a simple bytes-per-second rate limiter shared across calls
+// to pace IPFS uploads/downloads. A nil *tokenBucket or a non-positive rate
+// disables limiting.
+type tokenBucket struct {
+	mu       sync.Mutex
+	rate     float64 // bytes per second
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+// newTokenBucket creates a tokenBucket paced at ratePerSec bytes/second. A
+// ratePerSec of 0 disables limiting.
+func newTokenBucket(ratePerSec int64) *tokenBucket {
+	if ratePerSec <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:     float64(ratePerSec),
+		capacity: float64(ratePerSec), // allow up to one second of burst
+		tokens:   float64(ratePerSec),
+		last:     time.Now(),
+	}
+}
+
+// take blocks until n bytes of bandwidth budget are available.
+func (tb *tokenBucket) take(n int64) {
+	if tb == nil {
+		return
+	}
+
+	tb.mu.Lock()
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.capacity {
+		tb.tokens = tb.capacity
+	}
+	tb.last = now
+
+	if tb.tokens >= float64(n) {
+		tb.tokens -= float64(n)
+		tb.mu.Unlock()
+		return
+	}
+
+	wait := time.Duration((float64(n) - tb.tokens) / tb.rate * float64(time.Second))
+	tb.tokens = 0
+	tb.mu.Unlock()
+
+	time.Sleep(wait)
+}
+
 // RandomFS represents the main filesystem instance
 type RandomFS struct {
 	ipfsAPI    string
 	dataDir    string
+	shell      *shell.Shell
+	pinMode    string
+	publishMFS bool
 	blockCache *BlockCache
 	mutex      sync.RWMutex
 
+	// I/O pacing
+	inflightBytes   *byteSemaphore
+	inflightBlocks  concurrencySemaphore
+	uploadLimiter   *tokenBucket
+	downloadLimiter *tokenBucket
+
+	// Deduplication
+	dedup           bool
+	dedupIdx        *dedupIndex
+	dedupHits       int64
+	dedupBytesSaved int64
+
 	// Statistics
 	stats Stats
+
+	// onIPFSCall, if set, is invoked after every shell call with the
+	// operation name, its duration, and its error (nil on success), so a
+	// caller can feed it into metrics without this package depending on a
+	// metrics library.
+	onIPFSCall func(op string, d time.Duration, err error)
 }
 
 // Stats holds system statistics
@@ -53,14 +290,145 @@ type Stats struct {
 	TotalSize       int64 `json:"total_size"`
 	CacheHits       int64 `json:"cache_hits"`
 	CacheMisses     int64 `json:"cache_misses"`
+	CacheEvictions  int64 `json:"cache_evictions"`
+	CacheCoalesced  int64 `json:"cache_coalesced"`
+
+	// I/O pacing utilization
+	InflightBytes     int64 `json:"inflight_bytes"`
+	MaxInflightBytes  int64 `json:"max_inflight_bytes"`
+	InflightBlocks    int   `json:"inflight_blocks"`
+	MaxInflightBlocks int   `json:"max_inflight_blocks"`
+
+	// Deduplication
+	DedupHits       int64 `json:"dedup_hits"`
+	DedupBytesSaved int64 `json:"dedup_bytes_saved"`
+}
+
+// cacheEntry is the value stored in a BlockCache's LRU list.
+type cacheEntry struct {
+	hash string
+	data []byte
+}
+
+// blockFetchCall tracks a single in-flight IPFS fetch so that concurrent
+// misses for the same hash coalesce into one request.
+type blockFetchCall struct {
+	wg   sync.WaitGroup
+	data []byte
+	err  error
 }
 
-// BlockCache manages block storage and retrieval
+// BlockCache is a byte-budgeted LRU cache of IPFS blocks, with per-hash
+// single-flight coalescing of fetches and a short-lived negative cache for
+// hashes that are known not to exist.
 type BlockCache struct {
-	blocks      map[string][]byte
-	mutex       sync.RWMutex
+	mutex       sync.Mutex
+	items       map[string]*list.Element // hash -> element in lru
+	lru         *list.List               // front = most recently used
 	maxSize     int64
 	currentSize int64
+
+	negMutex sync.Mutex
+	negative map[string]time.Time
+
+	sfMutex sync.Mutex
+	sfCalls map[string]*blockFetchCall
+
+	hits, misses, evictions, coalesced int64
+}
+
+// newBlockCache creates an empty BlockCache with the given byte budget.
+func newBlockCache(maxSize int64) *BlockCache {
+	return &BlockCache{
+		items:    make(map[string]*list.Element),
+		lru:      list.New(),
+		maxSize:  maxSize,
+		negative: make(map[string]time.Time),
+		sfCalls:  make(map[string]*blockFetchCall),
+	}
+}
+
+// get returns the cached block for hash, if present, marking it
+// most-recently-used.
+func (c *BlockCache) get(hash string) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.items[hash]
+	if !ok {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	atomic.AddInt64(&c.hits, 1)
+	return elem.Value.(*cacheEntry).data, true
+}
+
+// put inserts or refreshes a block in the cache, evicting least-recently-used
+// entries until the cache is back under its byte budget.
+func (c *BlockCache) put(hash string, data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.items[hash]; ok {
+		c.currentSize -= int64(len(elem.Value.(*cacheEntry).data))
+		elem.Value = &cacheEntry{hash: hash, data: data}
+		c.currentSize += int64(len(data))
+		c.lru.MoveToFront(elem)
+	} else {
+		elem := c.lru.PushFront(&cacheEntry{hash: hash, data: data})
+		c.items[hash] = elem
+		c.currentSize += int64(len(data))
+	}
+
+	for c.currentSize > c.maxSize {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			break
+		}
+		entry := oldest.Value.(*cacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.items, entry.hash)
+		c.currentSize -= int64(len(entry.data))
+		atomic.AddInt64(&c.evictions, 1)
+	}
+}
+
+// purge clears all cached blocks.
+func (c *BlockCache) purge() {
+	c.mutex.Lock()
+	c.items = make(map[string]*list.Element)
+	c.lru = list.New()
+	c.currentSize = 0
+	c.mutex.Unlock()
+
+	c.negMutex.Lock()
+	c.negative = make(map[string]time.Time)
+	c.negMutex.Unlock()
+}
+
+// negativeHit reports whether hash was recently confirmed missing from IPFS.
+func (c *BlockCache) negativeHit(hash string) bool {
+	c.negMutex.Lock()
+	defer c.negMutex.Unlock()
+
+	expiry, ok := c.negative[hash]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiry) {
+		delete(c.negative, hash)
+		return false
+	}
+	return true
+}
+
+// markNegative records hash as missing for negativeCacheTTL.
+func (c *BlockCache) markNegative(hash string) {
+	c.negMutex.Lock()
+	c.negative[hash] = time.Now().Add(negativeCacheTTL)
+	c.negMutex.Unlock()
 }
 
 // FileRepresentation contains the metadata needed to reconstruct a file
@@ -72,6 +440,14 @@ type FileRepresentation struct {
 	Timestamp   int64    `json:"timestamp"`
 	ContentType string   `json:"content_type"`
 	Version     string   `json:"version"`
+
+	// BlockRandomizerHashes holds one randomizer block CID per entry in
+	// BlockHashes; the original chunk is recovered by XORing the two
+	// together. Dedup indicates whether the store reused randomizers from
+	// the persistent dedup index rather than generating a fresh one per
+	// block; it does not affect how a block is decoded.
+	Dedup                 bool     `json:"dedup,omitempty"`
+	BlockRandomizerHashes []string `json:"block_randomizer_hashes,omitempty"`
 }
 
 // RandomURL represents a rd:// URL for file access
@@ -87,21 +463,99 @@ type RandomURL struct {
 
 // NewRandomFS creates a new RandomFS instance
 func NewRandomFS(ipfsAPI string, dataDir string, cacheSize int64) (*RandomFS, error) {
+	return NewRandomFSWithConfig(Config{IPFSAPI: ipfsAPI, DataDir: dataDir, CacheSize: cacheSize})
+}
+
+// NewRandomFSWithLimits creates a new RandomFS instance with I/O pacing
+// applied to IPFS traffic. maxUploadBps/maxDownloadBps cap sustained
+// bandwidth in bytes/second, maxInflightBytes caps the total size of
+// concurrently in-flight blocks, and maxInflightBlocks caps the number of
+// concurrent IPFS HTTP requests. A limit of 0 leaves that dimension
+// unbounded.
+func NewRandomFSWithLimits(ipfsAPI string, dataDir string, cacheSize int64, maxUploadBps, maxDownloadBps, maxInflightBytes int64, maxInflightBlocks int) (*RandomFS, error) {
+	return NewRandomFSWithConfig(Config{
+		IPFSAPI:           ipfsAPI,
+		DataDir:           dataDir,
+		CacheSize:         cacheSize,
+		MaxUploadBps:      maxUploadBps,
+		MaxDownloadBps:    maxDownloadBps,
+		MaxInflightBytes:  maxInflightBytes,
+		MaxInflightBlocks: maxInflightBlocks,
+	})
+}
+
+// Config holds the tunables for a RandomFS instance. Zero values fall back
+// to sane defaults (see NewRandomFS).
+type Config struct {
+	IPFSAPI   string
+	DataDir   string
+	CacheSize int64
+
+	// I/O pacing; 0 leaves the corresponding dimension unbounded.
+	MaxUploadBps      int64
+	MaxDownloadBps    int64
+	MaxInflightBytes  int64
+	MaxInflightBlocks int
+
+	// Dedup enables the content-addressed deduplication path: identical
+	// chunks reuse a previously stored randomizer/result block pair instead
+	// of writing fresh blocks to IPFS.
+	Dedup bool
+
+	// PinMode controls how representation and block CIDs are pinned on
+	// store: "recursive" (default), "direct", or "none".
+	PinMode string
+
+	// PublishMFS, when true, copies each stored representation into MFS at
+	// /randomfs/<filename> after a successful store, so it's browsable via
+	// the IPFS Files API/WebUI. Failures are logged, not returned, since MFS
+	// publishing is a best-effort convenience on top of the store.
+	PublishMFS bool
+
+	// OnIPFSCall, if set, is called after every shell request (add, cat,
+	// pin) with the operation name, its duration, and its error, so a
+	// caller can record it (e.g. into Prometheus) without this package
+	// depending on a metrics library.
+	OnIPFSCall func(op string, d time.Duration, err error)
+}
+
+// NewRandomFSWithConfig creates a new RandomFS instance from cfg.
+func NewRandomFSWithConfig(cfg Config) (*RandomFS, error) {
+	ipfsAPI := cfg.IPFSAPI
 	if ipfsAPI == "" {
 		ipfsAPI = DefaultIPFSEndpoint
 	}
 
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
+	if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create data directory: %v", err)
 	}
 
+	pinMode := cfg.PinMode
+	if pinMode == "" {
+		pinMode = "recursive"
+	}
+
 	rfs := &RandomFS{
-		ipfsAPI: ipfsAPI,
-		dataDir: dataDir,
-		blockCache: &BlockCache{
-			blocks:  make(map[string][]byte),
-			maxSize: cacheSize,
-		},
+		ipfsAPI:         ipfsAPI,
+		dataDir:         cfg.DataDir,
+		shell:           shell.NewShell(ipfsAPI),
+		pinMode:         pinMode,
+		publishMFS:      cfg.PublishMFS,
+		blockCache:      newBlockCache(cfg.CacheSize),
+		inflightBytes:   newByteSemaphore(cfg.MaxInflightBytes),
+		inflightBlocks:  newConcurrencySemaphore(cfg.MaxInflightBlocks),
+		uploadLimiter:   newTokenBucket(cfg.MaxUploadBps),
+		downloadLimiter: newTokenBucket(cfg.MaxDownloadBps),
+		dedup:           cfg.Dedup,
+		onIPFSCall:      cfg.OnIPFSCall,
+	}
+
+	if cfg.Dedup {
+		idx, err := openDedupIndex(cfg.DataDir)
+		if err != nil {
+			return nil, err
+		}
+		rfs.dedupIdx = idx
 	}
 
 	// Test IPFS connection
@@ -109,7 +563,7 @@ func NewRandomFS(ipfsAPI string, dataDir string, cacheSize int64) (*RandomFS, er
 		return nil, fmt.Errorf("failed to connect to IPFS: %v", err)
 	}
 
-	log.Printf("RandomFS initialized with IPFS at %s, data dir %s", ipfsAPI, dataDir)
+	log.Printf("RandomFS initialized with IPFS at %s, data dir %s", ipfsAPI, cfg.DataDir)
 
 	return rfs, nil
 }
@@ -117,22 +571,35 @@ func NewRandomFS(ipfsAPI string, dataDir string, cacheSize int64) (*RandomFS, er
 // GetStats returns current system statistics
 func (rfs *RandomFS) GetStats() Stats {
 	rfs.mutex.RLock()
-	defer rfs.mutex.RUnlock()
-	return rfs.stats
+	stats := rfs.stats
+	rfs.mutex.RUnlock()
+
+	stats.CacheHits = atomic.LoadInt64(&rfs.blockCache.hits)
+	stats.CacheMisses = atomic.LoadInt64(&rfs.blockCache.misses)
+	stats.CacheEvictions = atomic.LoadInt64(&rfs.blockCache.evictions)
+	stats.CacheCoalesced = atomic.LoadInt64(&rfs.blockCache.coalesced)
+
+	stats.InflightBytes = rfs.inflightBytes.inUse()
+	stats.MaxInflightBytes = rfs.inflightBytes.max
+	stats.InflightBlocks = rfs.inflightBlocks.inUse()
+	stats.MaxInflightBlocks = cap(rfs.inflightBlocks)
+
+	stats.DedupHits = atomic.LoadInt64(&rfs.dedupHits)
+	stats.DedupBytesSaved = atomic.LoadInt64(&rfs.dedupBytesSaved)
+
+	return stats
+}
+
+// PurgeCache discards all cached blocks and negative-cache entries.
+func (rfs *RandomFS) PurgeCache() {
+	rfs.blockCache.purge()
 }
 
 // testIPFSConnection tests if IPFS daemon is accessible
 func (rfs *RandomFS) testIPFSConnection() error {
-	resp, err := http.Get(rfs.ipfsAPI + "/api/v0/version")
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("IPFS daemon not accessible, status: %d", resp.StatusCode)
+	if _, _, err := rfs.shell.Version(); err != nil {
+		return fmt.Errorf("IPFS daemon not accessible: %v", err)
 	}
-
 	return nil
 }
 
@@ -144,31 +611,34 @@ func (rfs *RandomFS) StoreFile(filename string, data []byte, contentType string)
 	// Determine block size based on file size
 	blockSize := rfs.selectBlockSize(int64(len(data)))
 
-	// Generate randomized blocks
-	blocks, err := rfs.generateRandomBlocks(data, blockSize)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate blocks: %v", err)
-	}
-
-	// Store blocks in IPFS and cache
+	// Chunk the file and store each chunk as a randomized block
 	var blockHashes []string
-	for _, block := range blocks {
-		hash, err := rfs.storeBlock(block)
+	var randomizerHashes []string
+	for offset := 0; offset < len(data); offset += blockSize {
+		end := offset + blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		resultHash, randomizerHash, err := rfs.storeChunk(data[offset:end], blockSize)
 		if err != nil {
 			return nil, fmt.Errorf("failed to store block: %v", err)
 		}
-		blockHashes = append(blockHashes, hash)
+		blockHashes = append(blockHashes, resultHash)
+		randomizerHashes = append(randomizerHashes, randomizerHash)
 	}
 
 	// Create file representation
 	rep := &FileRepresentation{
-		FileName:    filepath.Base(filename),
-		FileSize:    int64(len(data)),
-		BlockHashes: blockHashes,
-		BlockSize:   blockSize,
-		Timestamp:   time.Now().Unix(),
-		ContentType: contentType,
-		Version:     ProtocolVersion,
+		FileName:              filepath.Base(filename),
+		FileSize:              int64(len(data)),
+		BlockHashes:           blockHashes,
+		BlockSize:             blockSize,
+		Timestamp:             time.Now().Unix(),
+		ContentType:           contentType,
+		Version:               ProtocolVersion,
+		Dedup:                 rfs.dedup,
+		BlockRandomizerHashes: randomizerHashes,
 	}
 
 	// Store representation in IPFS
@@ -182,9 +652,15 @@ func (rfs *RandomFS) StoreFile(filename string, data []byte, contentType string)
 		return nil, fmt.Errorf("failed to store representation: %v", err)
 	}
 
+	if rfs.publishMFS {
+		if err := rfs.publishToMFS(rep.FileName, repHash); err != nil {
+			log.Printf("Failed to publish %s to MFS: %v", rep.FileName, err)
+		}
+	}
+
 	// Update statistics
 	rfs.stats.FilesStored++
-	rfs.stats.BlocksGenerated += int64(len(blocks))
+	rfs.stats.BlocksGenerated += int64(len(blockHashes))
 	rfs.stats.TotalSize += int64(len(data))
 
 	// Create RandomURL
@@ -199,7 +675,7 @@ func (rfs *RandomFS) StoreFile(filename string, data []byte, contentType string)
 	}
 
 	log.Printf("Stored file %s (%d bytes) with %d blocks, representation hash: %s",
-		filename, len(data), len(blocks), repHash)
+		filename, len(data), len(blockHashes), repHash)
 
 	return randomURL, nil
 }
@@ -225,17 +701,17 @@ func (rfs *RandomFS) RetrieveFile(repHash string) ([]byte, *FileRepresentation,
 			return nil, nil, fmt.Errorf("failed to retrieve block %d: %v", i, err)
 		}
 
-		// Apply XOR to de-randomize
-		if i < len(rep.BlockHashes)-1 {
-			// Full block
-			deRandomized := rfs.deRandomizeBlock(blockData, rep.BlockSize)
-			reconstructed.Write(deRandomized)
-		} else {
+		dataSize := rep.BlockSize
+		if i == len(rep.BlockHashes)-1 {
 			// Last block might be partial
-			remaining := rep.FileSize - int64(reconstructed.Len())
-			deRandomized := rfs.deRandomizeBlock(blockData, int(remaining))
-			reconstructed.Write(deRandomized)
+			dataSize = int(rep.FileSize - int64(reconstructed.Len()))
+		}
+
+		decoded, err := rfs.decodeBlock(&rep, i, blockData, dataSize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decode block %d: %v", i, err)
 		}
+		reconstructed.Write(decoded)
 	}
 
 	log.Printf("Retrieved file %s (%d bytes) from %d blocks",
@@ -244,42 +720,315 @@ func (rfs *RandomFS) RetrieveFile(repHash string) ([]byte, *FileRepresentation,
 	return reconstructed.Bytes(), &rep, nil
 }
 
-// generateRandomBlocks creates randomized blocks from file data
-func (rfs *RandomFS) generateRandomBlocks(data []byte, blockSize int) ([][]byte, error) {
-	var blocks [][]byte
+// StoreStream stores a file read incrementally from r, without buffering the
+// whole upload in memory. Since the total size isn't known up front, chunks
+// are cut at the large-file block size tier; block generation is pipelined to
+// IPFS via a bounded worker pool so uploads don't serialize on network I/O.
+func (rfs *RandomFS) StoreStream(filename string, r io.Reader, contentType string) (*RandomURL, error) {
+	blockSize := BlockSize
 
-	for offset := 0; offset < len(data); offset += blockSize {
-		end := offset + blockSize
-		if end > len(data) {
-			end = len(data)
+	type job struct {
+		index int
+		chunk []byte
+	}
+	type result struct {
+		index          int
+		hash           string
+		randomizerHash string
+		err            error
+	}
+
+	jobs := make(chan job)
+	results := make(chan result)
+
+	var workers sync.WaitGroup
+	for i := 0; i < streamWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for j := range jobs {
+				hash, randomizerHash, err := rfs.storeChunk(j.chunk, blockSize)
+				results <- result{index: j.index, hash: hash, randomizerHash: randomizerHash, err: err}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(results)
+		close(done)
+	}()
+
+	var readErr error
+	var fileSize int64
+	go func() {
+		defer close(jobs)
+		for i := 0; ; i++ {
+			buf := make([]byte, blockSize)
+			n, err := io.ReadFull(r, buf)
+			if n > 0 {
+				chunk := make([]byte, n)
+				copy(chunk, buf[:n])
+				fileSize += int64(n)
+				jobs <- job{index: i, chunk: chunk}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return
+			}
+			if err != nil {
+				readErr = fmt.Errorf("failed to read input: %v", err)
+				return
+			}
+		}
+	}()
+
+	hashes := make(map[int]string)
+	randomizerHashes := make(map[int]string)
+	var storeErr error
+	for res := range results {
+		// Keep draining results (and, transitively, jobs) to completion even
+		// after the first failure: returning early here would leave workers
+		// blocked sending on results, which blocks them from draining jobs,
+		// which blocks the read goroutine sending on jobs, leaking all of
+		// them.
+		if res.err != nil {
+			if storeErr == nil {
+				storeErr = fmt.Errorf("failed to store block: %v", res.err)
+			}
+			continue
 		}
+		hashes[res.index] = res.hash
+		randomizerHashes[res.index] = res.randomizerHash
+	}
+	<-done
+
+	if readErr != nil {
+		return nil, readErr
+	}
+	if storeErr != nil {
+		return nil, storeErr
+	}
+
+	blockHashes := make([]string, len(hashes))
+	blockRandomizerHashes := make([]string, len(randomizerHashes))
+	for i := range blockHashes {
+		blockHashes[i] = hashes[i]
+		blockRandomizerHashes[i] = randomizerHashes[i]
+	}
 
-		chunk := data[offset:end]
+	rep := &FileRepresentation{
+		FileName:              filepath.Base(filename),
+		FileSize:              fileSize,
+		BlockHashes:           blockHashes,
+		BlockSize:             blockSize,
+		Timestamp:             time.Now().Unix(),
+		ContentType:           contentType,
+		Version:               ProtocolVersion,
+		Dedup:                 rfs.dedup,
+		BlockRandomizerHashes: blockRandomizerHashes,
+	}
+
+	repData, err := json.Marshal(rep)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal representation: %v", err)
+	}
+
+	repHash, err := rfs.addToIPFS(repData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store representation: %v", err)
+	}
 
-		// Create random block of fixed size
-		randomBlock := make([]byte, blockSize)
-		if _, err := rand.Read(randomBlock); err != nil {
-			return nil, fmt.Errorf("failed to generate random data: %v", err)
+	if rfs.publishMFS {
+		if err := rfs.publishToMFS(rep.FileName, repHash); err != nil {
+			log.Printf("Failed to publish %s to MFS: %v", rep.FileName, err)
 		}
+	}
+
+	rfs.mutex.Lock()
+	rfs.stats.FilesStored++
+	rfs.stats.BlocksGenerated += int64(len(blockHashes))
+	rfs.stats.TotalSize += fileSize
+	rfs.mutex.Unlock()
+
+	randomURL := &RandomURL{
+		Scheme:    "rd",
+		Host:      "randomfs",
+		Version:   ProtocolVersion,
+		FileName:  rep.FileName,
+		FileSize:  rep.FileSize,
+		RepHash:   repHash,
+		Timestamp: rep.Timestamp,
+	}
+
+	log.Printf("Streamed file %s (%d bytes) with %d blocks, representation hash: %s",
+		filename, fileSize, len(blockHashes), repHash)
+
+	return randomURL, nil
+}
 
-		// XOR with actual data to create multi-use block
-		for i := 0; i < len(chunk); i++ {
-			randomBlock[i] ^= chunk[i]
+// GetRepresentation fetches and decodes the FileRepresentation for a
+// representation hash without reconstructing the file data.
+func (rfs *RandomFS) GetRepresentation(repHash string) (*FileRepresentation, error) {
+	repData, err := rfs.retrieveBlock(repHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve representation: %v", err)
+	}
+
+	var rep FileRepresentation
+	if err := json.Unmarshal(repData, &rep); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal representation: %v", err)
+	}
+
+	return &rep, nil
+}
+
+// RetrieveStream writes the byte range [off, off+length) of the file
+// identified by repHash to w, fetching only the blocks that overlap the
+// requested range. If length is negative, it streams through the end of the
+// file.
+func (rfs *RandomFS) RetrieveStream(repHash string, w io.Writer, off, length int64) error {
+	rep, err := rfs.GetRepresentation(repHash)
+	if err != nil {
+		return err
+	}
+
+	return rfs.retrieveStreamFromRepresentation(rep, w, off, length)
+}
+
+// RetrieveStreamFromRepresentation is like RetrieveStream but takes an
+// already-resolved FileRepresentation, letting a caller that holds one for
+// the duration of a larger operation (an HTTP request, an open FUSE file
+// handle) reuse it across multiple reads instead of re-fetching and
+// re-decoding the representation block on every call.
+func (rfs *RandomFS) RetrieveStreamFromRepresentation(rep *FileRepresentation, w io.Writer, off, length int64) error {
+	return rfs.retrieveStreamFromRepresentation(rep, w, off, length)
+}
+
+func (rfs *RandomFS) retrieveStreamFromRepresentation(rep *FileRepresentation, w io.Writer, off, length int64) error {
+	if off < 0 || off > rep.FileSize {
+		return fmt.Errorf("invalid range offset %d for file of size %d", off, rep.FileSize)
+	}
+
+	end := rep.FileSize
+	if length >= 0 && off+length < end {
+		end = off + length
+	}
+
+	blockSize := int64(rep.BlockSize)
+	startBlock := int(off / blockSize)
+	remaining := end - off
+	pos := off
+
+	for i := startBlock; i < len(rep.BlockHashes) && remaining > 0; i++ {
+		blockData, err := rfs.retrieveBlock(rep.BlockHashes[i])
+		if err != nil {
+			return fmt.Errorf("failed to retrieve block %d: %v", i, err)
+		}
+
+		blockStart := int64(i) * blockSize
+		dataSize := blockSize
+		if blockStart+dataSize > rep.FileSize {
+			dataSize = rep.FileSize - blockStart
+		}
+		decoded, err := rfs.decodeBlock(rep, i, blockData, int(dataSize))
+		if err != nil {
+			return fmt.Errorf("failed to decode block %d: %v", i, err)
+		}
+
+		skip := pos - blockStart
+		chunk := decoded[skip:]
+		if int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+
+		if _, err := w.Write(chunk); err != nil {
+			return fmt.Errorf("failed to write output: %v", err)
 		}
 
-		blocks = append(blocks, randomBlock)
+		pos += int64(len(chunk))
+		remaining -= int64(len(chunk))
 	}
 
-	return blocks, nil
+	return nil
 }
 
-// deRandomizeBlock recovers original data from a randomized block
-func (rfs *RandomFS) deRandomizeBlock(block []byte, dataSize int) []byte {
-	// For this implementation, we're using a simple XOR approach
-	// In a real system, this would involve more complex cryptographic operations
-	result := make([]byte, dataSize)
-	copy(result, block[:dataSize])
-	return result
+// storeChunk stores a single source chunk as a randomized block, returning
+// the result block's CID and its randomizer block's CID: reconstruction
+// always needs both, since the pad isn't recoverable from the result block
+// alone. When dedup is enabled, chunks that have already been stored reuse
+// their recorded randomizer/result pair instead of writing new blocks to
+// IPFS.
+func (rfs *RandomFS) storeChunk(chunk []byte, blockSize int) (resultHash, randomizerHash string, err error) {
+	var chunkHash [32]byte
+	if rfs.dedup {
+		chunkHash = sha256.Sum256(chunk)
+		entry, found, err := rfs.dedupIdx.lookup(chunkHash)
+		if err != nil {
+			return "", "", fmt.Errorf("dedup index lookup failed: %v", err)
+		}
+		if found {
+			atomic.AddInt64(&rfs.dedupHits, 1)
+			atomic.AddInt64(&rfs.dedupBytesSaved, int64(len(chunk)))
+			return entry.ResultHash, entry.RandomizerHash, nil
+		}
+	}
+
+	randomBlock := make([]byte, blockSize)
+	if _, err := rand.Read(randomBlock); err != nil {
+		return "", "", fmt.Errorf("failed to generate random data: %v", err)
+	}
+
+	result := make([]byte, blockSize)
+	copy(result, randomBlock)
+	for i := 0; i < len(chunk); i++ {
+		result[i] ^= chunk[i]
+	}
+
+	resultHash, err = rfs.storeBlock(result)
+	if err != nil {
+		return "", "", err
+	}
+
+	randomizerHash, err = rfs.storeBlock(randomBlock)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to store randomizer block: %v", err)
+	}
+
+	if rfs.dedup {
+		if err := rfs.dedupIdx.store(chunkHash, dedupEntry{RandomizerHash: randomizerHash, ResultHash: resultHash}); err != nil {
+			return "", "", fmt.Errorf("failed to update dedup index: %v", err)
+		}
+	}
+
+	return resultHash, randomizerHash, nil
+}
+
+// reconstructBlock recovers a chunk by XORing its stored result block
+// against its randomizer block.
+func (rfs *RandomFS) reconstructBlock(result, randomizer []byte, dataSize int) []byte {
+	out := make([]byte, dataSize)
+	for i := 0; i < dataSize; i++ {
+		out[i] = result[i] ^ randomizer[i]
+	}
+	return out
+}
+
+// decodeBlock recovers the original chunk for block i of rep by fetching its
+// randomizer block and XORing it against the stored result block. Every
+// block carries a randomizer hash regardless of rfs.dedup; dedup only
+// controls whether that randomizer is reused across chunks.
+func (rfs *RandomFS) decodeBlock(rep *FileRepresentation, i int, blockData []byte, dataSize int) ([]byte, error) {
+	if i >= len(rep.BlockRandomizerHashes) || rep.BlockRandomizerHashes[i] == "" {
+		return nil, fmt.Errorf("representation is missing a randomizer hash for block %d", i)
+	}
+
+	randomizerData, err := rfs.retrieveBlock(rep.BlockRandomizerHashes[i])
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve randomizer block: %v", err)
+	}
+
+	return rfs.reconstructBlock(blockData, randomizerData, dataSize), nil
 }
 
 // storeBlock stores a block in IPFS and local cache
@@ -289,48 +1038,52 @@ func (rfs *RandomFS) storeBlock(block []byte) (string, error) {
 		return "", err
 	}
 
-	// Cache locally for faster access
-	rfs.blockCache.mutex.Lock()
-	defer rfs.blockCache.mutex.Unlock()
-
-	rfs.blockCache.blocks[hash] = block
-	rfs.blockCache.currentSize += int64(len(block))
-
-	// Simple cache eviction if over limit
-	if rfs.blockCache.currentSize > rfs.blockCache.maxSize {
-		rfs.evictOldestBlocks()
-	}
+	rfs.blockCache.put(hash, block)
 
 	return hash, nil
 }
 
-// retrieveBlock retrieves a block from cache or IPFS
+// retrieveBlock retrieves a block from cache or IPFS, coalescing concurrent
+// misses for the same hash into a single IPFS fetch.
 func (rfs *RandomFS) retrieveBlock(hash string) ([]byte, error) {
-	// Check cache first
-	rfs.blockCache.mutex.RLock()
-	if block, exists := rfs.blockCache.blocks[hash]; exists {
-		rfs.blockCache.mutex.RUnlock()
-		rfs.stats.CacheHits++
+	if block, ok := rfs.blockCache.get(hash); ok {
 		return block, nil
 	}
-	rfs.blockCache.mutex.RUnlock()
 
-	// Retrieve from IPFS
-	rfs.stats.CacheMisses++
-	return rfs.catFromIPFS(hash)
-}
+	if rfs.blockCache.negativeHit(hash) {
+		return nil, ErrBlockNotFound
+	}
 
-// evictOldestBlocks removes oldest blocks from cache
-func (rfs *RandomFS) evictOldestBlocks() {
-	// Simple implementation - remove half the cache
-	target := rfs.blockCache.maxSize / 2
-	for hash, block := range rfs.blockCache.blocks {
-		delete(rfs.blockCache.blocks, hash)
-		rfs.blockCache.currentSize -= int64(len(block))
-		if rfs.blockCache.currentSize <= target {
-			break
-		}
+	rfs.blockCache.sfMutex.Lock()
+	if call, inFlight := rfs.blockCache.sfCalls[hash]; inFlight {
+		rfs.blockCache.sfMutex.Unlock()
+		atomic.AddInt64(&rfs.blockCache.coalesced, 1)
+		call.wg.Wait()
+		return call.data, call.err
 	}
+
+	call := &blockFetchCall{}
+	call.wg.Add(1)
+	rfs.blockCache.sfCalls[hash] = call
+	rfs.blockCache.sfMutex.Unlock()
+
+	call.data, call.err = rfs.catFromIPFS(hash)
+
+	rfs.blockCache.sfMutex.Lock()
+	delete(rfs.blockCache.sfCalls, hash)
+	rfs.blockCache.sfMutex.Unlock()
+	call.wg.Done()
+
+	if call.err == ErrBlockNotFound {
+		rfs.blockCache.markNegative(hash)
+		return nil, call.err
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+
+	rfs.blockCache.put(hash, call.data)
+	return call.data, nil
 }
 
 // selectBlockSize determines the appropriate block size for a file
@@ -343,58 +1096,147 @@ func (rfs *RandomFS) selectBlockSize(fileSize int64) int {
 	return BlockSize
 }
 
-// addToIPFS adds data to IPFS using HTTP API
+// addToIPFS adds data to IPFS via the shell client, paced by the configured
+// upload rate limiter and bounded by the in-flight byte/request semaphores.
+// The added object is pinned according to rfs.pinMode.
 func (rfs *RandomFS) addToIPFS(data []byte) (string, error) {
-	var buf bytes.Buffer
-	writer := multipart.NewWriter(&buf)
+	rfs.uploadLimiter.take(int64(len(data)))
 
-	part, err := writer.CreateFormFile("file", "data")
+	rfs.inflightBytes.take(int64(len(data)))
+	defer rfs.inflightBytes.give(int64(len(data)))
+
+	rfs.inflightBlocks.acquire()
+	defer rfs.inflightBlocks.release()
+
+	start := time.Now()
+	hash, err := rfs.shell.Add(bytes.NewReader(data))
+	rfs.reportIPFSCall("add", start, err)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("IPFS add failed: %v", err)
 	}
 
-	if _, err := part.Write(data); err != nil {
-		return "", err
+	if err := rfs.pinHash(hash); err != nil {
+		log.Printf("Failed to pin %s: %v", hash, err)
 	}
 
-	if err := writer.Close(); err != nil {
-		return "", err
+	return hash, nil
+}
+
+// catFromIPFS retrieves data from IPFS via the shell client, bounded by the
+// in-flight request semaphore and paced by the configured download rate
+// limiter.
+func (rfs *RandomFS) catFromIPFS(hash string) ([]byte, error) {
+	rfs.inflightBlocks.acquire()
+	defer rfs.inflightBlocks.release()
+
+	// Reserve a worst-case block's worth of byte budget and download
+	// bandwidth before making the call, same as addToIPFS does for uploads,
+	// so io.ReadAll's allocation is actually bounded by the budget instead
+	// of happening first and being accounted for afterward. Blocks are
+	// never larger than BlockSize.
+	rfs.downloadLimiter.take(BlockSize)
+	rfs.inflightBytes.take(BlockSize)
+	defer rfs.inflightBytes.give(BlockSize)
+
+	start := time.Now()
+	reader, err := rfs.shell.Cat(hash)
+	rfs.reportIPFSCall("cat", start, err)
+	if err != nil {
+		if isIPFSNotFound(err) {
+			return nil, ErrBlockNotFound
+		}
+		return nil, fmt.Errorf("IPFS cat failed: %v", err)
 	}
+	defer reader.Close()
 
-	resp, err := http.Post(rfs.ipfsAPI+"/api/v0/add", writer.FormDataContentType(), &buf)
+	data, err := io.ReadAll(reader)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("IPFS add failed with status: %d", resp.StatusCode)
+	return data, nil
+}
+
+// reportIPFSCall invokes onIPFSCall, if configured, with the elapsed time
+// since start. It is a no-op when no hook is set.
+func (rfs *RandomFS) reportIPFSCall(op string, start time.Time, err error) {
+	if rfs.onIPFSCall != nil {
+		rfs.onIPFSCall(op, time.Since(start), err)
 	}
+}
+
+// isIPFSNotFound reports whether err is the shell client's representation of
+// a missing block or path.
+func isIPFSNotFound(err error) bool {
+	return strings.Contains(err.Error(), "not found") || strings.Contains(err.Error(), "no link named")
+}
 
-	var result struct {
-		Hash string `json:"Hash"`
+// pinHash pins hash according to rfs.pinMode ("recursive", "direct", or
+// "none").
+func (rfs *RandomFS) pinHash(hash string) error {
+	if rfs.pinMode == "" || rfs.pinMode == "none" {
+		return nil
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", err
+	start := time.Now()
+	var err error
+	if rfs.pinMode == "direct" {
+		err = rfs.shell.Request("pin/add", hash).Option("recursive", false).Exec(context.Background(), nil)
+	} else { // "recursive"
+		err = rfs.shell.Pin(hash)
 	}
+	rfs.reportIPFSCall("pin", start, err)
+	return err
+}
 
-	return result.Hash, nil
+// UnpinHash removes a pin previously set by pinHash.
+func (rfs *RandomFS) UnpinHash(hash string) error {
+	if err := rfs.shell.Unpin(hash); err != nil {
+		return fmt.Errorf("failed to unpin %s: %v", hash, err)
+	}
+	return nil
 }
 
-// catFromIPFS retrieves data from IPFS using HTTP API
-func (rfs *RandomFS) catFromIPFS(hash string) ([]byte, error) {
-	resp, err := http.Get(rfs.ipfsAPI + "/api/v0/cat?arg=" + hash)
-	if err != nil {
-		return nil, err
+// GC triggers an IPFS repo garbage collection, reclaiming space held by
+// unpinned blocks.
+func (rfs *RandomFS) GC() error {
+	if err := rfs.shell.Request("repo/gc").Exec(context.Background(), nil); err != nil {
+		return fmt.Errorf("IPFS repo gc failed: %v", err)
+	}
+	return nil
+}
+
+// publishToMFS copies a stored representation into MFS at
+// /randomfs/<filename> so it's browsable via the IPFS Files API/WebUI.
+func (rfs *RandomFS) publishToMFS(filename, repHash string) error {
+	ctx := context.Background()
+
+	if err := rfs.shell.FilesMkdir(ctx, "/randomfs", shell.FilesMkdir.Parents(true)); err != nil {
+		return fmt.Errorf("failed to create /randomfs in MFS: %v", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("IPFS cat failed with status: %d", resp.StatusCode)
+	dest := "/randomfs/" + filename
+	if err := rfs.shell.FilesRm(ctx, dest, true); err != nil {
+		// Best effort: the path may not exist yet.
+		_ = err
 	}
 
-	return io.ReadAll(resp.Body)
+	if err := rfs.shell.FilesCp(ctx, "/ipfs/"+repHash, dest); err != nil {
+		return fmt.Errorf("failed to publish %s to MFS: %v", dest, err)
+	}
+
+	return nil
+}
+
+// PublishLatest publishes repHash under the IPNS key named name, so clients
+// can resolve a stable ipns:// link to the most recent representation
+// stored under that logical name. It returns the resolvable IPNS name.
+func (rfs *RandomFS) PublishLatest(name, repHash string) (string, error) {
+	resp, err := rfs.shell.PublishWithDetails(repHash, name, 0, 0, false)
+	if err != nil {
+		return "", fmt.Errorf("failed to publish IPNS record: %v", err)
+	}
+	return resp.Name, nil
 }
 
 // ParseRandomURL parses a rd:// URL